@@ -0,0 +1,505 @@
+// Copyright (C) 2015  The GoHBase Authors.  All rights reserved.
+// This file is part of GoHBase.
+// Use of this source code is governed by the Apache License 2.0
+// that can be found in the COPYING file.
+
+package region
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tsuna/gohbase/hrpc"
+	"golang.org/x/net/context"
+)
+
+// drainPollInterval is how often CloseGracefully checks whether every
+// in-flight RPC has been answered, and how often processRPCs checks
+// whether CloseGracefully is waiting for it to flush its current batch.
+const drainPollInterval = 10 * time.Millisecond
+
+// ClientType is a type alias to represent the type of this region client
+type ClientType int
+
+const (
+	// RegionClient means that this ClientType is a client to a RegionServer
+	RegionClient ClientType = iota
+
+	// MasterClient means this ClientType is a client to the Master server
+	MasterClient
+
+	defaultRPCQueueSize  = 100
+	defaultFlushInterval = 20 * time.Millisecond
+)
+
+// ErrClientDead is the error delivered to any RPC queued after the client
+// has failed or started closing. RPCs still queued or waiting for a
+// response when the client fails get UnrecoverableError{cause}, which is
+// ErrClientDead itself when Close was the cause.
+var ErrClientDead = UnrecoverableError{errors.New("client is dead")}
+
+// UnrecoverableError is an error that this region.client can't recover
+// from, and hence is irremediably dead.
+type UnrecoverableError struct {
+	error
+}
+
+// call pairs an hrpc.Call with the RPC id it was assigned when it was
+// handed to sendBatch, so that receiveRPCs can match a response with the
+// call that's waiting for it.
+type call struct {
+	id uint32
+	hrpc.Call
+}
+
+// client manages a connection to a RegionServer or the Master, batching
+// up queued RPCs and writing them out on one goroutine while another
+// goroutine reads responses back off the wire.
+type client struct {
+	transport Transport
+
+	// mu guards err and the decision to close rpcs, so fail() only ever
+	// runs its cleanup once and never races a concurrent QueueRPC send.
+	mu  sync.Mutex
+	err error
+
+	rpcQueueSize  int
+	flushInterval time.Duration
+
+	id uint32 // Incremented atomically to generate RPC ids.
+
+	// rpcs is where QueueRPC hands off calls to processRPCs.
+	rpcs chan hrpc.Call
+	// sent holds calls that have been written to the wire but not yet
+	// answered, keyed by the RPC id they were sent with.
+	sent map[uint32]hrpc.Call
+
+	// done is closed by fail() to tell processRPCs and receiveRPCs to
+	// stop, and to tell QueueRPC to stop accepting new work.
+	done chan struct{}
+
+	// deadlines feeds newly-sent calls that carry a context deadline to
+	// watchDeadlines. cancelled records the ids watchDeadlines gave up on,
+	// so receiveRPCs knows to discard a late response instead of trying to
+	// deliver it on a channel nobody is reading anymore. cancelled is
+	// guarded by mu, same as sent.
+	deadlines chan deadlineEntry
+	cancelled map[uint32]struct{}
+
+	// draining is set by CloseGracefully to make QueueRPC reject new
+	// work while processRPCs keeps flushing what's already queued.
+	draining bool
+
+	// batchLen is processRPCs' local batch size, mirrored here under mu so
+	// CloseGracefully can see RPCs that have been pulled off rpcs but not
+	// yet recorded in sent -- without it, that window is invisible to
+	// CloseGracefully's drain check.
+	batchLen int
+
+	// The following fields support WithReconnect; reconnect is nil unless
+	// it was configured, in which case a transport error triggers
+	// reconnectLoop instead of fail().
+	clientType   ClientType
+	newTransport func(net.Conn) Transport
+	dial         func() (net.Conn, error)
+	reconnect    *ReconnectPolicy
+
+	// reconnecting is set while reconnectLoop is trying to re-establish
+	// the connection; QueueRPC blocks on resumed instead of failing
+	// outright while it's true.
+	reconnecting bool
+	resumed      chan struct{}
+}
+
+// Option configures optional behavior of a client created by NewClient.
+type Option func(*options)
+
+type options struct {
+	newTransport func(net.Conn) Transport
+	reconnect    *ReconnectPolicy
+}
+
+// WithTransport overrides the Transport used to frame RPCs on top of conn,
+// letting callers layer SASL/GSSAPI auth, TLS, or a capture/replay
+// decorator on top of the connection without patching package region.
+func WithTransport(newTransport func(net.Conn) Transport) Option {
+	return func(o *options) {
+		o.newTransport = newTransport
+	}
+}
+
+// WithReconnect makes the client survive a transport error by redialing
+// and resuming instead of failing every RPC with ErrClientDead; see
+// ReconnectPolicy.
+func WithReconnect(policy ReconnectPolicy) Option {
+	return func(o *options) {
+		o.reconnect = &policy
+	}
+}
+
+// dialTimeout bounds how long a single reconnect attempt's dial may take.
+const dialTimeout = 5 * time.Second
+
+// NewClient creates a region client and starts its read and write loops.
+func NewClient(conn net.Conn, clientType ClientType, queueSize int,
+	flushInterval time.Duration, effectiveUser string, opts ...Option) (hrpc.RegionClient, error) {
+
+	o := &options{newTransport: newDefaultTransport(effectiveUser)}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	c := &client{
+		transport:     o.newTransport(conn),
+		clientType:    clientType,
+		newTransport:  o.newTransport,
+		reconnect:     o.reconnect,
+		rpcQueueSize:  queueSize,
+		flushInterval: flushInterval,
+		rpcs:          make(chan hrpc.Call, queueSize),
+		sent:          make(map[uint32]hrpc.Call),
+		done:          make(chan struct{}),
+		deadlines:     make(chan deadlineEntry, queueSize),
+		cancelled:     make(map[uint32]struct{}),
+	}
+	if raddr := conn.RemoteAddr(); raddr != nil {
+		c.dial = func() (net.Conn, error) {
+			return net.DialTimeout(raddr.Network(), raddr.String(), dialTimeout)
+		}
+	}
+
+	if err := c.transport.SendHello(clientType); err != nil {
+		return nil, err
+	}
+
+	go c.processRPCs()
+	go c.receiveRPCs()
+	go c.watchDeadlines()
+
+	return c, nil
+}
+
+// QueueRPC queues an RPC to be sent to the server. If the client has
+// already failed, the call is immediately completed with
+// UnrecoverableError{ErrClientDead}. While the client is reconnecting (see
+// WithReconnect), QueueRPC instead blocks until the connection is
+// re-established or rpc's Context is done, so a transient region-server
+// restart doesn't bubble up as ErrClientDead to every queued RPC.
+func (c *client) QueueRPC(rpc hrpc.Call) {
+	for {
+		c.mu.Lock()
+		if c.err != nil || c.draining {
+			c.mu.Unlock()
+			c.sendError(rpc, ErrClientDead)
+			return
+		}
+		if !c.reconnecting {
+			select {
+			case c.rpcs <- rpc:
+				c.mu.Unlock()
+				return
+			default:
+			}
+			// rpcs is full. Don't wait for room while holding mu: processRPCs
+			// only makes room again once sendBatch, which needs mu, is done.
+			c.mu.Unlock()
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		resumed := c.resumed
+		c.mu.Unlock()
+
+		select {
+		case <-resumed:
+			// try again: either reconnected, or gave up and failed.
+		case <-rpc.Context().Done():
+			c.sendError(rpc, rpc.Context().Err())
+			return
+		}
+	}
+}
+
+// processRPCs is the writer goroutine. It batches up queued calls, either
+// when rpcQueueSize calls have accumulated or flushInterval has elapsed
+// since the first call in the batch arrived, and hands the batch to
+// sendBatch. Once CloseGracefully has started draining, a pending batch is
+// handed over within drainPollInterval instead.
+func (c *client) processRPCs() {
+	batch := make([]*call, 0, c.rpcQueueSize)
+	var timer *time.Timer
+
+	for {
+		if len(batch) == 0 {
+			rpc, ok := <-c.rpcs
+			if !ok {
+				return
+			}
+			batch = append(batch, c.newCall(rpc))
+			c.setBatchLen(len(batch))
+			timer = time.NewTimer(c.flushInterval)
+		}
+
+		select {
+		case rpc, ok := <-c.rpcs:
+			if !ok {
+				timer.Stop()
+				c.sendBatch(batch)
+				c.setBatchLen(0)
+				return
+			}
+			batch = append(batch, c.newCall(rpc))
+			c.setBatchLen(len(batch))
+			if len(batch) < c.rpcQueueSize {
+				continue
+			}
+		case <-timer.C:
+		case <-time.After(drainPollInterval):
+			c.mu.Lock()
+			draining := c.draining
+			c.mu.Unlock()
+			if !draining {
+				continue
+			}
+		}
+
+		timer.Stop()
+		c.sendBatch(batch)
+		c.setBatchLen(0)
+		batch = batch[:0]
+	}
+}
+
+// setBatchLen records processRPCs' current local batch size in batchLen, so
+// CloseGracefully's drain check can see RPCs that are in neither rpcs nor
+// sent because processRPCs is holding them, not yet having handed them to
+// sendBatch.
+func (c *client) setBatchLen(n int) {
+	c.mu.Lock()
+	c.batchLen = n
+	c.mu.Unlock()
+}
+
+// newCall assigns the next RPC id to rpc and wraps it as a *call.
+func (c *client) newCall(rpc hrpc.Call) *call {
+	return &call{id: atomic.AddUint32(&c.id, 1), Call: rpc}
+}
+
+// sendBatch serializes and writes out every call in batch, skipping any
+// whose context has already been canceled, and records each written call
+// in c.sent so receiveRPCs can dispatch its response. Once the client has
+// failed, or a write fails partway through the batch, the rest of the
+// batch is still accounted for (so callers waiting on ResultChan aren't
+// left hanging) without touching the wire.
+func (c *client) sendBatch(batch []*call) {
+	for i, rpc := range batch {
+		select {
+		case <-c.done:
+			for _, rest := range batch[i:] {
+				c.sendError(rest, ErrClientDead)
+			}
+			return
+		default:
+		}
+
+		ctx := rpc.Context()
+		if err := ctx.Err(); err != nil {
+			c.sendError(rpc, err)
+			continue
+		}
+
+		name := rpc.Name()
+		payload, err := rpc.Serialize()
+		if err != nil {
+			c.sendError(rpc, fmt.Errorf("failed to serialize RPC: %v", err))
+			continue
+		}
+
+		c.mu.Lock()
+		if c.reconnecting {
+			// The transport this write would use is already known dead --
+			// reconnectLoop is re-dialing on another goroutine -- so don't
+			// bother; tell the caller to resubmit once it's back, same as
+			// whatever was already in c.sent when the failure happened.
+			c.mu.Unlock()
+			c.sendError(rpc, ErrClientReconnecting)
+			continue
+		}
+		c.sent[rpc.id] = rpc.Call
+		transport := c.transport
+		c.mu.Unlock()
+
+		if err := transport.WriteRPC(rpc.id, name, payload); err != nil {
+			// rpc is already in c.sent; fold the rest of the batch in there
+			// too, so handleTransportError's existing draining of c.sent
+			// (fail, or reconnectLoop) resolves every one of them instead of
+			// leaving them to block on ResultChan forever.
+			c.mu.Lock()
+			for _, rest := range batch[i+1:] {
+				c.sent[rest.id] = rest.Call
+			}
+			c.mu.Unlock()
+			c.handleTransportError(transport, err)
+			return
+		}
+
+		if deadline, ok := ctx.Deadline(); ok {
+			select {
+			case c.deadlines <- deadlineEntry{deadline: deadline, id: rpc.id}:
+			case <-c.done:
+			}
+		}
+	}
+}
+
+// receiveRPCs is the reader goroutine. It reads one response at a time
+// off the wire and delivers it to the call waiting for it in c.sent. A
+// response for an id that watchDeadlines already gave up on is silently
+// discarded instead of delivered, since nothing may be reading its
+// ResultChan by the time it arrives.
+func (c *client) receiveRPCs() {
+	// The transport is fixed for the lifetime of this goroutine: a new one
+	// is only ever installed, under c.mu, right before reconnectLoop starts
+	// a fresh receiveRPCs to use it.
+	c.mu.Lock()
+	transport := c.transport
+	c.mu.Unlock()
+
+	for {
+		id, body, err := transport.ReadResponse()
+		if err != nil {
+			c.handleTransportError(transport, fmt.Errorf("failed to read: %s", err))
+			return
+		}
+
+		c.mu.Lock()
+		if _, ok := c.cancelled[id]; ok {
+			delete(c.cancelled, id)
+			c.mu.Unlock()
+			continue
+		}
+		rpc, ok := c.sent[id]
+		if ok {
+			delete(c.sent, id)
+		}
+		c.mu.Unlock()
+		if !ok {
+			continue
+		}
+		rpc.ResultChan() <- parseResponse(body)
+	}
+}
+
+// sendError delivers err to rpc's result channel.
+func (c *client) sendError(rpc hrpc.Call, err error) {
+	rpc.ResultChan() <- hrpc.RPCResult{Error: err}
+}
+
+// fail marks the client as dead: every call still waiting in c.sent gets
+// UnrecoverableError{err}, the connection is closed, and done/rpcs are
+// closed so no further RPCs are accepted. It is safe to call concurrently
+// and more than once; only the first call has any effect.
+func (c *client) fail(err error) {
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return
+	}
+	c.err = err
+	sent := c.sent
+	c.sent = make(map[uint32]hrpc.Call)
+	transport := c.transport
+	c.mu.Unlock()
+
+	ue := UnrecoverableError{err}
+	for _, rpc := range sent {
+		rpc.ResultChan() <- hrpc.RPCResult{Error: ue}
+	}
+
+	close(c.done)
+	transport.Close()
+
+	for {
+		select {
+		case rpc, ok := <-c.rpcs:
+			if !ok {
+				return
+			}
+			rpc.ResultChan() <- hrpc.RPCResult{Error: ue}
+		default:
+			c.mu.Lock()
+			close(c.rpcs)
+			c.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Close shuts the client down immediately: any RPC still queued up or
+// awaiting a response fails with UnrecoverableError{ErrClientDead}. Use
+// CloseGracefully to let outstanding work finish first.
+func (c *client) Close() {
+	c.fail(ErrClientDead.error)
+}
+
+// CloseGracefully stops the client from accepting new RPCs, waits for
+// every RPC already queued or in flight to be written and answered, and
+// only then closes the connection. If ctx expires before the drain
+// completes, it falls back to the immediate shutdown that Close performs,
+// so whatever is still outstanding fails with
+// UnrecoverableError{ErrClientDead} like it would have otherwise.
+func (c *client) CloseGracefully(ctx context.Context) error {
+	c.mu.Lock()
+	if c.err != nil {
+		// Already shut down, gracefully or not.
+		c.mu.Unlock()
+		return nil
+	}
+	c.draining = true
+	c.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for {
+			c.mu.Lock()
+			empty := len(c.rpcs) == 0 && len(c.sent) == 0 && c.batchLen == 0
+			c.mu.Unlock()
+			if empty {
+				return
+			}
+			select {
+			case <-time.After(drainPollInterval):
+			case <-c.done:
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-drained:
+	case <-c.done:
+		// Something else (e.g. a write/read error) already killed the
+		// client while we were waiting.
+		return nil
+	case <-ctx.Done():
+		c.fail(ErrClientDead.error)
+		return ctx.Err()
+	}
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil
+	}
+	c.err = ErrClientDead.error
+	close(c.done)
+	close(c.rpcs)
+	transport := c.transport
+	c.mu.Unlock()
+
+	return transport.Close()
+}
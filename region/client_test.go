@@ -27,94 +27,20 @@ func TestErrors(t *testing.T) {
 	}
 }
 
-func TestWrite(t *testing.T) {
-	ctrl := gomock.NewController(t)
-	defer ctrl.Finish()
-	mockConn := mock.NewMockReadWriteCloser(ctrl)
-	c := &client{
-		conn: mockConn,
-	}
-
-	// check if Write returns an error
-	expectErr := errors.New("nope")
-	mockConn.EXPECT().Write(gomock.Any()).Return(0, expectErr).Times(1)
-	err := c.write([]byte("lol"))
-	if diff := test.Diff(expectErr, err); diff != "" {
-		t.Errorf("Expected: %#v\nReceived: %#v\nDiff:%s",
-			expectErr, err, diff)
-	}
-
-	// check if it returns ErrShortWrite
-	mockConn.EXPECT().Write(gomock.Any()).Return(1, nil).Times(1)
-	err = c.write([]byte("lol"))
-	if diff := test.Diff(ErrShortWrite, err); diff != "" {
-		t.Errorf("Expected: %#v\nReceived: %#v\nDiff:%s",
-			ErrShortWrite, err, diff)
-	}
-
-	// check if it actually writes the right data
-	expected := []byte("lol")
-	mockConn.EXPECT().Write(gomock.Any()).Return(3, nil).Times(1).Do(func(buf []byte) {
-		if diff := test.Diff(expected, buf); diff != "" {
-			t.Errorf("Expected: %#v\nReceived: %#v\nDiff:%s",
-				expected, buf, diff)
-		}
-	})
-	err = c.write(expected)
-	if err != nil {
-		t.Errorf("Was expecting error, but got one: %#v", err)
-	}
-}
-
-func TestSendHello(t *testing.T) {
-	ctrl := gomock.NewController(t)
-	defer ctrl.Finish()
-	mockConn := mock.NewMockReadWriteCloser(ctrl)
-	c := &client{
-		conn: mockConn,
-	}
-
-	// check if it's sending the right "hello" for RegionClient
-	mockConn.EXPECT().Write(gomock.Any()).Return(35, nil).Times(1).Do(func(buf []byte) {
-		expected := []byte("HBas\x00P\x00\x00\x00\x19\n\b\n\x06gopher\x12\rClientService")
-		if diff := test.Diff(expected, buf); diff != "" {
-			t.Errorf("Type RegionClient:\n Expected: %#v\nReceived: %#v\nDiff:%s",
-				expected, buf, diff)
-		}
-	})
-	err := c.sendHello(RegionClient)
-	if err != nil {
-		t.Errorf("Was expecting error, but got one: %#v", err)
-	}
-
-	// check if it sends the right "hello" for MasterClient
-	mockConn.EXPECT().Write(gomock.Any()).Return(35, nil).Times(1).Do(func(buf []byte) {
-		expected := []byte("HBas\x00P\x00\x00\x00\x19\n\b\n\x06gopher\x12\rMasterService")
-		if diff := test.Diff(expected, buf); diff != "" {
-			t.Errorf("Type MasterClient:\n Expected: %#v\nReceived: %#v\nDiff:%s",
-				expected, buf, diff)
-		}
-	})
-	err = c.sendHello(MasterClient)
-	if err != nil {
-		t.Errorf("Was expecting error, but got one: %#v", err)
-	}
-}
-
 func TestFail(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
-	mockConn := mock.NewMockReadWriteCloser(ctrl)
+	mockTransport := mock.NewMockTransport(ctrl)
 	c := &client{
-		conn: mockConn,
-		done: make(chan struct{}),
-		rpcs: make(chan hrpc.Call),
-		sent: make(map[uint32]hrpc.Call),
+		transport: mockTransport,
+		done:      make(chan struct{}),
+		rpcs:      make(chan hrpc.Call),
+		sent:      make(map[uint32]hrpc.Call),
 	}
 	expectedErr := errors.New("oooups")
 
-	// check that connection Close is called only once
-	mockConn.EXPECT().Close().Times(1)
+	// check that the transport is closed only once
+	mockTransport.EXPECT().Close().Times(1)
 
 	// run multiple in parallel to make sure everything is called only once
 	var wg sync.WaitGroup
@@ -181,10 +107,10 @@ func TestBufferedRPCsFail(t *testing.T) {
 
 	queueSize := 100
 	flushInterval := 1000 * time.Second
-	mockConn := mock.NewMockReadWriteCloser(ctrl)
-	mockConn.EXPECT().Close().Times(1)
+	mockTransport := mock.NewMockTransport(ctrl)
+	mockTransport.EXPECT().Close().Times(1)
 	c := &client{
-		conn:          mockConn,
+		transport:     mockTransport,
 		rpcs:          make(chan hrpc.Call, queueSize),
 		done:          make(chan struct{}),
 		sent:          make(map[uint32]hrpc.Call),
@@ -232,9 +158,9 @@ func TestQueueRPC(t *testing.T) {
 
 	queueSize := 30
 	flushInterval := 20 * time.Millisecond
-	mockConn := mock.NewMockReadWriteCloser(ctrl)
+	mockTransport := mock.NewMockTransport(ctrl)
 	c := &client{
-		conn:          mockConn,
+		transport:     mockTransport,
 		rpcs:          make(chan hrpc.Call, queueSize),
 		done:          make(chan struct{}),
 		sent:          make(map[uint32]hrpc.Call),
@@ -262,11 +188,11 @@ func TestQueueRPC(t *testing.T) {
 		mockCall.EXPECT().ResultChan().Return(make(chan hrpc.RPCResult, 1)).Times(1)
 		calls[i] = mockCall
 
-		// we expect that it eventually writes to connection
-		mockConn.EXPECT().Write(newRPCMatcher(payload)).Times(1).Return(15+len(payload), nil).Do(
-			func(buf []byte) {
-				wgWrites.Done()
-			})
+		// we expect that it eventually writes to the transport
+		mockTransport.EXPECT().WriteRPC(gomock.Any(), "lol", newRPCMatcher(payload)).
+			Times(1).Return(nil).Do(func(id uint32, name string, payload []byte) {
+			wgWrites.Done()
+		})
 	}
 
 	// queue calls in parallel
@@ -290,7 +216,7 @@ func TestQueueRPC(t *testing.T) {
 
 	var wg sync.WaitGroup
 	// now we fail the regionserver, and try to queue stuff
-	mockConn.EXPECT().Close().Times(1)
+	mockTransport.EXPECT().Close().Times(1)
 	c.fail(errors.New("ooups"))
 	for i := 0; i < 100; i++ {
 		wg.Add(1)
@@ -322,9 +248,9 @@ func TestUnrecoverableErrorWrite(t *testing.T) {
 
 	queueSize := 1
 	flushInterval := 10 * time.Millisecond
-	mockConn := mock.NewMockReadWriteCloser(ctrl)
+	mockTransport := mock.NewMockTransport(ctrl)
 	c := &client{
-		conn:          mockConn,
+		transport:     mockTransport,
 		rpcs:          make(chan hrpc.Call, queueSize),
 		done:          make(chan struct{}),
 		sent:          make(map[uint32]hrpc.Call),
@@ -339,10 +265,11 @@ func TestUnrecoverableErrorWrite(t *testing.T) {
 	mockCall.EXPECT().Context().Return(context.Background()).Times(1)
 	result := make(chan hrpc.RPCResult, 1)
 	mockCall.EXPECT().ResultChan().Return(result).Times(1)
-	// we expect that it eventually writes to connection
+	// we expect that it eventually writes to the transport
 	expErr := errors.New("Write failure")
-	mockConn.EXPECT().Write(newRPCMatcher(payload)).Times(1).Return(0, expErr)
-	mockConn.EXPECT().Close()
+	mockTransport.EXPECT().WriteRPC(gomock.Any(), "lol", newRPCMatcher(payload)).
+		Times(1).Return(expErr)
+	mockTransport.EXPECT().Close()
 
 	c.QueueRPC(mockCall)
 	c.processRPCs()
@@ -366,9 +293,9 @@ func TestUnrecoverableErrorRead(t *testing.T) {
 
 	queueSize := 1
 	flushInterval := 10 * time.Millisecond
-	mockConn := mock.NewMockReadWriteCloser(ctrl)
+	mockTransport := mock.NewMockTransport(ctrl)
 	c := &client{
-		conn:          mockConn,
+		transport:     mockTransport,
 		rpcs:          make(chan hrpc.Call, queueSize),
 		done:          make(chan struct{}),
 		sent:          make(map[uint32]hrpc.Call),
@@ -379,8 +306,8 @@ func TestUnrecoverableErrorRead(t *testing.T) {
 	mockCall := mock.NewMockCall(ctrl)
 	result := make(chan hrpc.RPCResult, 1)
 	mockCall.EXPECT().ResultChan().Return(result).Times(1)
-	mockConn.EXPECT().Read([]byte{0, 0, 0, 0}).Return(0, errors.New("read failure"))
-	mockConn.EXPECT().Close()
+	mockTransport.EXPECT().ReadResponse().Return(uint32(0), nil, errors.New("read failure"))
+	mockTransport.EXPECT().Close()
 
 	// pretend we already unqueued and sent the rpc
 	c.sent[1] = mockCall
@@ -413,9 +340,9 @@ func TestUnexpectedSendError(t *testing.T) {
 
 	queueSize := 1
 	flushInterval := 10 * time.Millisecond
-	mockConn := mock.NewMockReadWriteCloser(ctrl)
+	mockTransport := mock.NewMockTransport(ctrl)
 	c := &client{
-		conn:          mockConn,
+		transport:     mockTransport,
 		rpcs:          make(chan hrpc.Call, queueSize),
 		done:          make(chan struct{}),
 		sent:          make(map[uint32]hrpc.Call),
@@ -443,7 +370,7 @@ func TestUnexpectedSendError(t *testing.T) {
 		t.Errorf("Expected all awaiting rpcs to be processed, %d left", len(c.sent))
 	}
 	// stop the go routine
-	mockConn.EXPECT().Close()
+	mockTransport.EXPECT().Close()
 	c.Close()
 }
 
@@ -452,16 +379,16 @@ func TestSendBatch(t *testing.T) {
 	defer ctrl.Finish()
 	queueSize := 1
 	flushInterval := 10 * time.Millisecond
-	mockConn := mock.NewMockReadWriteCloser(ctrl)
+	mockTransport := mock.NewMockTransport(ctrl)
 	c := &client{
-		conn:          mockConn,
+		transport:     mockTransport,
 		rpcs:          make(chan hrpc.Call, queueSize),
 		done:          make(chan struct{}),
 		sent:          make(map[uint32]hrpc.Call),
 		rpcQueueSize:  queueSize,
 		flushInterval: flushInterval,
 	}
-	mockConn.EXPECT().Close()
+	mockTransport.EXPECT().Close()
 
 	batch := make([]*call, 9)
 	ctx := context.Background()
@@ -478,10 +405,10 @@ func TestSendBatch(t *testing.T) {
 			payload := fmt.Sprintf("rpc_%d", i)
 			mockCall.EXPECT().Serialize().Return([]byte(payload), nil).Times(1)
 			mockCall.EXPECT().Context().Return(ctx).Times(1)
-			// we expect that it eventually writes to connection
+			// we expect that it eventually writes to the transport
 			i := i
-			mockConn.EXPECT().Write(newRPCMatcher(payload)).Times(1).Return(
-				15+len(payload), nil).Do(func(buf []byte) {
+			mockTransport.EXPECT().WriteRPC(uint32(i), "lol", newRPCMatcher(payload)).
+				Times(1).Return(nil).Do(func(id uint32, name string, payload []byte) {
 				if i == 5 {
 					// we close on 6th rpc to check if sendBatch stop appropriately
 					c.Close()
@@ -502,16 +429,16 @@ func TestFlushInterval(t *testing.T) {
 	defer ctrl.Finish()
 	queueSize := 100000
 	flushInterval := 30 * time.Millisecond
-	mockConn := mock.NewMockReadWriteCloser(ctrl)
+	mockTransport := mock.NewMockTransport(ctrl)
 	c := &client{
-		conn:          mockConn,
+		transport:     mockTransport,
 		rpcs:          make(chan hrpc.Call, queueSize),
 		done:          make(chan struct{}),
 		sent:          make(map[uint32]hrpc.Call),
 		rpcQueueSize:  queueSize,
 		flushInterval: flushInterval,
 	}
-	mockConn.EXPECT().Close()
+	mockTransport.EXPECT().Close()
 
 	ctx := context.Background()
 	var wgWrites sync.WaitGroup
@@ -523,8 +450,8 @@ func TestFlushInterval(t *testing.T) {
 		mockCall.EXPECT().Serialize().Return([]byte(payload), nil).Times(1)
 		mockCall.EXPECT().Context().Return(ctx).Times(1)
 		mockCall.EXPECT().ResultChan().Return(make(chan hrpc.RPCResult, 1)).Times(1)
-		mockConn.EXPECT().Write(newRPCMatcher(payload)).Times(1).Return(
-			15+len(payload), nil).Do(func(buf []byte) {
+		mockTransport.EXPECT().WriteRPC(gomock.Any(), "lol", newRPCMatcher(payload)).
+			Times(1).Return(nil).Do(func(id uint32, name string, payload []byte) {
 			wgWrites.Done()
 		})
 		c.QueueRPC(mockCall)
@@ -547,16 +474,16 @@ func TestQueueSize(t *testing.T) {
 	defer ctrl.Finish()
 	queueSize := 10
 	flushInterval := 10000 * time.Second
-	mockConn := mock.NewMockReadWriteCloser(ctrl)
+	mockTransport := mock.NewMockTransport(ctrl)
 	c := &client{
-		conn:          mockConn,
+		transport:     mockTransport,
 		rpcs:          make(chan hrpc.Call, queueSize),
 		done:          make(chan struct{}),
 		sent:          make(map[uint32]hrpc.Call),
 		rpcQueueSize:  queueSize,
 		flushInterval: flushInterval,
 	}
-	mockConn.EXPECT().Close()
+	mockTransport.EXPECT().Close()
 
 	ctx := context.Background()
 	var wgWrites sync.WaitGroup
@@ -568,8 +495,8 @@ func TestQueueSize(t *testing.T) {
 		mockCall.EXPECT().Serialize().Return([]byte(payload), nil).Times(1)
 		mockCall.EXPECT().Context().Return(ctx).Times(1)
 		mockCall.EXPECT().ResultChan().Return(make(chan hrpc.RPCResult, 1)).Times(1)
-		mockConn.EXPECT().Write(newRPCMatcher(payload)).Times(1).Return(
-			15+len(payload), nil).Do(func(buf []byte) {
+		mockTransport.EXPECT().WriteRPC(gomock.Any(), "lol", newRPCMatcher(payload)).
+			Times(1).Return(nil).Do(func(id uint32, name string, payload []byte) {
 			wgWrites.Done()
 		})
 		c.QueueRPC(mockCall)
@@ -586,3 +513,151 @@ func TestQueueSize(t *testing.T) {
 	c.Close()
 	wgProcessRPCs.Wait()
 }
+
+func TestCloseGracefullyWaitsForOutstandingRPCs(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockTransport := mock.NewMockTransport(ctrl)
+	mockTransport.EXPECT().Close().Times(1)
+	c := &client{
+		transport: mockTransport,
+		rpcs:      make(chan hrpc.Call),
+		done:      make(chan struct{}),
+		sent:      make(map[uint32]hrpc.Call),
+	}
+
+	// pretend an RPC is still in flight
+	mockCall := mock.NewMockCall(ctrl)
+	c.sent[1] = mockCall
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.CloseGracefully(context.Background())
+	}()
+
+	// new RPCs should be rejected right away, before the drain completes
+	result := make(chan hrpc.RPCResult, 1)
+	rejected := mock.NewMockCall(ctrl)
+	rejected.EXPECT().ResultChan().Return(result).Times(1)
+	c.QueueRPC(rejected)
+	r := <-result
+	if _, ok := r.Error.(UnrecoverableError); !ok {
+		t.Errorf("Expected UnrecoverableError while draining, got %#v", r.Error)
+	}
+
+	select {
+	case <-errc:
+		t.Fatalf("CloseGracefully returned before the in-flight RPC was answered")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the in-flight RPC finally gets its response
+	c.mu.Lock()
+	delete(c.sent, 1)
+	c.mu.Unlock()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Expected no error, got %#v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("CloseGracefully never returned once the in-flight RPC was answered")
+	}
+}
+
+func TestCloseGracefullyContextExpires(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockTransport := mock.NewMockTransport(ctrl)
+	mockTransport.EXPECT().Close().Times(1)
+	c := &client{
+		transport: mockTransport,
+		rpcs:      make(chan hrpc.Call),
+		done:      make(chan struct{}),
+		sent:      make(map[uint32]hrpc.Call),
+	}
+
+	result := make(chan hrpc.RPCResult, 1)
+	mockCall := mock.NewMockCall(ctrl)
+	mockCall.EXPECT().ResultChan().Return(result).Times(1)
+	c.sent[1] = mockCall
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := c.CloseGracefully(ctx)
+	if diff := test.Diff(context.DeadlineExceeded, err); diff != "" {
+		t.Errorf("Expected: %#v\nReceived: %#v\nDiff:%s", context.DeadlineExceeded, err, diff)
+	}
+
+	r := <-result
+	if _, ok := r.Error.(UnrecoverableError); !ok {
+		t.Errorf("Expected UnrecoverableError for the RPC left in flight, got %#v", r.Error)
+	}
+}
+
+// TestCloseGracefullyWaitsForBatchedRPC exercises the real QueueRPC ->
+// processRPCs -> sendBatch path, not c.sent poked directly: it queues an
+// RPC and calls CloseGracefully well before flushInterval elapses, while
+// the RPC is sitting in processRPCs' local batch and invisible to both
+// c.rpcs and c.sent. CloseGracefully must still wait for it to be written
+// rather than reporting the client drained out from under it.
+func TestCloseGracefullyWaitsForBatchedRPC(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockTransport := mock.NewMockTransport(ctrl)
+	mockTransport.EXPECT().Close().Times(1)
+	c := &client{
+		transport:     mockTransport,
+		rpcs:          make(chan hrpc.Call, 1),
+		done:          make(chan struct{}),
+		sent:          make(map[uint32]hrpc.Call),
+		rpcQueueSize:  10,
+		flushInterval: time.Hour,
+	}
+	go c.processRPCs()
+
+	written := make(chan struct{})
+	result := make(chan hrpc.RPCResult, 1)
+	mockCall := mock.NewMockCall(ctrl)
+	mockCall.EXPECT().Name().Return("lol").Times(1)
+	mockCall.EXPECT().Serialize().Return([]byte("rpc_0"), nil).Times(1)
+	mockCall.EXPECT().Context().Return(context.Background()).Times(1)
+	mockCall.EXPECT().ResultChan().Return(result).Times(1)
+	mockTransport.EXPECT().WriteRPC(gomock.Any(), "lol", newRPCMatcher("rpc_0")).
+		Times(1).Return(nil).Do(func(id uint32, name string, payload []byte) {
+		close(written)
+	})
+	c.QueueRPC(mockCall)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.CloseGracefully(context.Background())
+	}()
+
+	select {
+	case <-written:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("CloseGracefully let the batched RPC get dropped instead of flushed")
+	}
+
+	// the written RPC finally gets its response
+	c.mu.Lock()
+	answered := c.sent[1]
+	delete(c.sent, 1)
+	c.mu.Unlock()
+	answered.ResultChan() <- hrpc.RPCResult{}
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("Expected no error, got %#v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("CloseGracefully never returned once the batched RPC was answered")
+	}
+}
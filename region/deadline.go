@@ -0,0 +1,90 @@
+// Copyright (C) 2015  The GoHBase Authors.  All rights reserved.
+// This file is part of GoHBase.
+// Use of this source code is governed by the Apache License 2.0
+// that can be found in the COPYING file.
+
+package region
+
+import (
+	"container/heap"
+	"time"
+
+	"github.com/tsuna/gohbase/hrpc"
+	"golang.org/x/net/context"
+)
+
+// deadlineEntry is what sendBatch hands to watchDeadlines for every call
+// whose context carries a deadline.
+type deadlineEntry struct {
+	deadline time.Time
+	id       uint32
+}
+
+// deadlineHeap is a min-heap of deadlineEntry ordered by deadline, so
+// watchDeadlines can always find the next one to expire in O(log n)
+// instead of scanning every outstanding call on each tick.
+type deadlineHeap []deadlineEntry
+
+func (h deadlineHeap) Len() int            { return len(h) }
+func (h deadlineHeap) Less(i, j int) bool  { return h[i].deadline.Before(h[j].deadline) }
+func (h deadlineHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *deadlineHeap) Push(x interface{}) { *h = append(*h, x.(deadlineEntry)) }
+func (h *deadlineHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	*h = old[:n-1]
+	return e
+}
+
+// watchDeadlines is the single goroutine that enforces per-RPC context
+// deadlines on the read side: sendBatch feeds it one deadlineEntry per
+// call that has a deadline, and it expires them in deadline order without
+// having to scan c.sent on every tick.
+func (c *client) watchDeadlines() {
+	var h deadlineHeap
+	for {
+		var timerC <-chan time.Time
+		if len(h) > 0 {
+			timerC = time.After(time.Until(h[0].deadline))
+		}
+
+		select {
+		case e, ok := <-c.deadlines:
+			if !ok {
+				return
+			}
+			heap.Push(&h, e)
+		case <-timerC:
+			now := time.Now()
+			for len(h) > 0 && !h[0].deadline.After(now) {
+				c.expireDeadline(heap.Pop(&h).(deadlineEntry).id)
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// expireDeadline is called by watchDeadlines once id's deadline has
+// passed. If the call is still outstanding, it's removed from c.sent and
+// failed with context.DeadlineExceeded -- watchDeadlines only reaches here
+// once the deadline itself has elapsed, so there's no need to go back to
+// the call for its Context() -- and id is remembered in c.cancelled so
+// receiveRPCs discards the response if the region server answers anyway.
+// If id already isn't in c.sent -- the response already arrived, or the
+// client already failed or is reconnecting -- there's nothing to do.
+func (c *client) expireDeadline(id uint32) {
+	c.mu.Lock()
+	rpc, ok := c.sent[id]
+	if ok {
+		delete(c.sent, id)
+		c.cancelled[id] = struct{}{}
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	rpc.ResultChan() <- hrpc.RPCResult{Error: context.DeadlineExceeded}
+}
@@ -0,0 +1,80 @@
+// Copyright (C) 2015  The GoHBase Authors.  All rights reserved.
+// This file is part of GoHBase.
+// Use of this source code is governed by the Apache License 2.0
+// that can be found in the COPYING file.
+
+package region
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aristanetworks/goarista/test"
+	"github.com/golang/mock/gomock"
+	"github.com/tsuna/gohbase/hrpc"
+	"github.com/tsuna/gohbase/test/mock"
+	"golang.org/x/net/context"
+)
+
+func TestDeadlineExpiresOutstandingRPC(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockTransport := mock.NewMockTransport(ctrl)
+	// the region server never answers; receiveRPCs just parks here.
+	mockTransport.EXPECT().ReadResponse().DoAndReturn(func() (uint32, []byte, error) {
+		block := make(chan struct{})
+		<-block
+		return 0, nil, errors.New("unused")
+	}).AnyTimes()
+
+	c := &client{
+		transport:     mockTransport,
+		rpcs:          make(chan hrpc.Call, 1),
+		done:          make(chan struct{}),
+		sent:          make(map[uint32]hrpc.Call),
+		cancelled:     make(map[uint32]struct{}),
+		deadlines:     make(chan deadlineEntry, 1),
+		rpcQueueSize:  1,
+		flushInterval: time.Millisecond,
+	}
+	go c.processRPCs()
+	go c.receiveRPCs()
+	go c.watchDeadlines()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	mockCall := mock.NewMockCall(ctrl)
+	mockCall.EXPECT().Context().Return(ctx).Times(1)
+	mockCall.EXPECT().Name().Return("lol").Times(1)
+	mockCall.EXPECT().Serialize().Return([]byte("rpc_0"), nil).Times(1)
+	result := make(chan hrpc.RPCResult, 1)
+	mockCall.EXPECT().ResultChan().Return(result).Times(1)
+	mockTransport.EXPECT().WriteRPC(gomock.Any(), "lol", newRPCMatcher("rpc_0")).Times(1).Return(nil)
+
+	c.QueueRPC(mockCall)
+
+	select {
+	case r := <-result:
+		if diff := test.Diff(context.DeadlineExceeded, r.Error); diff != "" {
+			t.Errorf("Expected: %#v\nReceived: %#v\nDiff:%s",
+				context.DeadlineExceeded, r.Error, diff)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expired RPC never received context.DeadlineExceeded")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(c.sent) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(c.sent); n != 0 {
+		t.Errorf("Expected c.sent to be empty once the RPC expired, got %d left", n)
+	}
+
+	// clean up
+	mockTransport.EXPECT().Close()
+	c.Close()
+}
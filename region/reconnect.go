@@ -0,0 +1,165 @@
+// Copyright (C) 2015  The GoHBase Authors.  All rights reserved.
+// This file is part of GoHBase.
+// Use of this source code is governed by the Apache License 2.0
+// that can be found in the COPYING file.
+
+package region
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/tsuna/gohbase/hrpc"
+)
+
+// ErrClientReconnecting is delivered to any RPC that was in flight when the
+// connection failed and the client is retrying it (see WithReconnect).
+// Unlike UnrecoverableError{ErrClientDead}, it isn't fatal: the caller is
+// expected to resubmit the RPC.
+var ErrClientReconnecting = errors.New("client is reconnecting, resubmit the rpc")
+
+// ReconnectPolicy configures how a client created with WithReconnect
+// retries a failed connection instead of dying outright.
+type ReconnectPolicy struct {
+	// MaxAttempts caps how many times the client redials before giving up
+	// and failing like it would have without a ReconnectPolicy. Zero means
+	// retry forever.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry. Subsequent
+	// retries double it, up to MaxBackoff.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between retries.
+	MaxBackoff time.Duration
+
+	// Jitter adds up to +/- Jitter*backoff of randomness to each delay,
+	// to keep many clients from redialing in lockstep. 0 disables it.
+	Jitter float64
+}
+
+// handleTransportError is called whenever sendBatch or receiveRPCs hits an
+// error talking to transport. Since sendBatch and receiveRPCs each hold
+// their own snapshot of c.transport taken before the error happened,
+// transport may no longer be c.transport by the time this runs -- e.g. a
+// reconnect already replaced it and this is the old receiveRPCs goroutine
+// finally unblocking from the transport.Close() that triggered it. In that
+// case the error is stale and ignored; only a failure of the client's
+// current transport is acted on.
+//
+// With no ReconnectPolicy configured, acting on it is equivalent to
+// fail(err). Otherwise it marks the client as reconnecting -- which makes
+// sendBatch stop trying to write to the now-dead transport and QueueRPC
+// stop handing it new work -- drains whatever was already queued past
+// those gates, closes the dead transport so its receiveRPCs unblocks
+// instead of leaking, and hands the client over to reconnectLoop.
+func (c *client) handleTransportError(transport Transport, err error) {
+	c.mu.Lock()
+	if c.err != nil || c.reconnecting || transport != c.transport {
+		c.mu.Unlock()
+		return
+	}
+	if c.reconnect == nil || c.dial == nil {
+		c.mu.Unlock()
+		c.fail(err)
+		return
+	}
+	c.reconnecting = true
+	c.resumed = make(chan struct{})
+
+	// Anything still waiting in rpcs was queued for the same dead
+	// transport; drain it here too, not just c.sent, and hand it back with
+	// ErrClientReconnecting so its caller resubmits it.
+	var queued []hrpc.Call
+	for {
+		select {
+		case rpc := <-c.rpcs:
+			queued = append(queued, rpc)
+			continue
+		default:
+		}
+		break
+	}
+	c.mu.Unlock()
+
+	// Force the dead transport's receiveRPCs to unblock from ReadResponse
+	// now instead of leaking until the peer eventually times it out; by
+	// the time it does unblock, the transport != c.transport check above
+	// will make its own handleTransportError call a no-op.
+	transport.Close()
+
+	for _, rpc := range queued {
+		rpc.ResultChan() <- hrpc.RPCResult{Error: ErrClientReconnecting}
+	}
+
+	go c.reconnectLoop(err)
+}
+
+// reconnectLoop drains whatever was waiting on c.sent with the retryable
+// ErrClientReconnecting, then redials with exponential backoff until it
+// succeeds, MaxAttempts is exhausted, or the client is closed outright.
+// On success it installs the new Transport and restarts receiveRPCs;
+// processRPCs was never stopped, so it resumes sending as soon as
+// reconnecting is cleared.
+func (c *client) reconnectLoop(cause error) {
+	c.mu.Lock()
+	sent := c.sent
+	c.sent = make(map[uint32]hrpc.Call)
+	c.mu.Unlock()
+	for _, rpc := range sent {
+		rpc.ResultChan() <- hrpc.RPCResult{Error: ErrClientReconnecting}
+	}
+
+	backoff := c.reconnect.InitialBackoff
+	for attempt := 0; c.reconnect.MaxAttempts == 0 || attempt < c.reconnect.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(jitter(backoff, c.reconnect.Jitter)):
+			case <-c.done:
+				return
+			}
+			backoff *= 2
+			if backoff > c.reconnect.MaxBackoff {
+				backoff = c.reconnect.MaxBackoff
+			}
+		}
+
+		conn, err := c.dial()
+		if err != nil {
+			continue
+		}
+
+		transport := c.newTransport(conn)
+		if err := transport.SendHello(c.clientType); err != nil {
+			transport.Close()
+			continue
+		}
+
+		c.mu.Lock()
+		c.transport = transport
+		c.reconnecting = false
+		resumed := c.resumed
+		c.mu.Unlock()
+		close(resumed)
+
+		go c.receiveRPCs()
+		return
+	}
+
+	c.fail(cause)
+
+	c.mu.Lock()
+	resumed := c.resumed
+	c.mu.Unlock()
+	close(resumed)
+}
+
+// jitter adds up to +/- frac*d of randomness to d.
+func jitter(d time.Duration, frac float64) time.Duration {
+	if frac <= 0 {
+		return d
+	}
+	delta := float64(d) * frac * (2*rand.Float64() - 1)
+	return d + time.Duration(delta)
+}
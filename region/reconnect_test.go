@@ -0,0 +1,217 @@
+// Copyright (C) 2015  The GoHBase Authors.  All rights reserved.
+// This file is part of GoHBase.
+// Use of this source code is governed by the Apache License 2.0
+// that can be found in the COPYING file.
+
+package region
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aristanetworks/goarista/test"
+	"github.com/golang/mock/gomock"
+	"github.com/tsuna/gohbase/hrpc"
+	"github.com/tsuna/gohbase/test/mock"
+	"golang.org/x/net/context"
+)
+
+// fakeConn is a bare-bones net.Conn good enough to hand to a Transport
+// factory in tests; reconnectLoop only ever passes it straight through.
+type fakeConn struct{}
+
+func (fakeConn) Read(b []byte) (int, error)       { return 0, io.EOF }
+func (fakeConn) Write(b []byte) (int, error)      { return len(b), nil }
+func (fakeConn) Close() error                     { return nil }
+func (fakeConn) LocalAddr() net.Addr              { return nil }
+func (fakeConn) RemoteAddr() net.Addr             { return nil }
+func (fakeConn) SetDeadline(time.Time) error      { return nil }
+func (fakeConn) SetReadDeadline(time.Time) error  { return nil }
+func (fakeConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestReconnectAfterConsecutiveFailures(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	transports := []*mock.MockTransport{
+		mock.NewMockTransport(ctrl), // first redial: handshake fails too
+		mock.NewMockTransport(ctrl), // second redial: succeeds for good
+	}
+	// receiveRPCs gets restarted against the winning transport; park it so
+	// it doesn't trigger further reconnects while the test is asserting.
+	block := make(chan struct{})
+	for _, tr := range transports {
+		tr.EXPECT().ReadResponse().DoAndReturn(func() (uint32, []byte, error) {
+			<-block
+			return 0, nil, errors.New("unused")
+		}).AnyTimes()
+	}
+
+	deadTransport := mock.NewMockTransport(ctrl)
+	deadTransport.EXPECT().Close().Times(1)
+
+	var dialed int
+	c := &client{
+		clientType:    RegionClient,
+		transport:     deadTransport,
+		rpcQueueSize:  1,
+		flushInterval: time.Millisecond,
+		rpcs:          make(chan hrpc.Call, 1),
+		sent:          make(map[uint32]hrpc.Call),
+		done:          make(chan struct{}),
+		reconnect: &ReconnectPolicy{
+			MaxAttempts:    5,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+		},
+		dial: func() (net.Conn, error) { return fakeConn{}, nil },
+		newTransport: func(net.Conn) Transport {
+			tr := transports[dialed]
+			dialed++
+			return tr
+		},
+	}
+
+	// two consecutive failures: the first redial's handshake fails, the
+	// second one succeeds.
+	transports[0].EXPECT().SendHello(RegionClient).Return(errors.New("handshake failed"))
+	// reconnectLoop closes a transport whose handshake failed.
+	transports[0].EXPECT().Close().Times(1)
+	reconnected := make(chan struct{})
+	transports[1].EXPECT().SendHello(RegionClient).Return(nil).Do(
+		func(ClientType) { close(reconnected) })
+
+	c.handleTransportError(deadTransport, errors.New("write failed"))
+
+	// an RPC queued while the client is reconnecting should block, not
+	// fail outright, and go through once the connection is re-established.
+	mockCall := mock.NewMockCall(ctrl)
+	mockCall.EXPECT().Context().Return(context.Background()).AnyTimes()
+	queued := make(chan struct{})
+	go func() {
+		c.QueueRPC(mockCall)
+		close(queued)
+	}()
+
+	select {
+	case <-reconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("client never reconnected after two attempts")
+	}
+
+	select {
+	case <-queued:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("QueueRPC never unblocked once the client reconnected")
+	}
+
+	if c.transport != transports[1] {
+		t.Errorf("expected the reconnected transport to be installed on the client")
+	}
+	if rpc := <-c.rpcs; rpc != mockCall {
+		t.Errorf("expected the previously blocked RPC to finally be queued")
+	}
+}
+
+func TestReconnectDrainsSentWithRetryableError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	reconnectedTransport := mock.NewMockTransport(ctrl)
+	block := make(chan struct{})
+	reconnectedTransport.EXPECT().ReadResponse().DoAndReturn(
+		func() (uint32, []byte, error) {
+			<-block
+			return 0, nil, errors.New("unused")
+		}).AnyTimes()
+	reconnectedTransport.EXPECT().SendHello(RegionClient).Return(nil)
+
+	deadTransport := mock.NewMockTransport(ctrl)
+	deadTransport.EXPECT().Close().Times(1)
+
+	c := &client{
+		clientType:    RegionClient,
+		transport:     deadTransport,
+		rpcQueueSize:  1,
+		flushInterval: time.Millisecond,
+		rpcs:          make(chan hrpc.Call, 1),
+		sent:          make(map[uint32]hrpc.Call),
+		done:          make(chan struct{}),
+		reconnect: &ReconnectPolicy{
+			MaxAttempts:    5,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+		},
+		dial:         func() (net.Conn, error) { return fakeConn{}, nil },
+		newTransport: func(net.Conn) Transport { return reconnectedTransport },
+	}
+
+	result := make(chan hrpc.RPCResult, 1)
+	inFlight := mock.NewMockCall(ctrl)
+	inFlight.EXPECT().ResultChan().Return(result).Times(1)
+	c.sent[1] = inFlight
+
+	c.handleTransportError(deadTransport, errors.New("read failed"))
+
+	select {
+	case r := <-result:
+		if diff := test.Diff(ErrClientReconnecting, r.Error); diff != "" {
+			t.Errorf("Expected: %#v\nReceived: %#v\nDiff:%s",
+				ErrClientReconnecting, r.Error, diff)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("in-flight RPC never received ErrClientReconnecting")
+	}
+}
+
+// TestHandleTransportErrorIgnoresStaleTransport covers the race where a
+// transport's receiveRPCs is still blocked in ReadResponse when a write on
+// the same transport fails, trips handleTransportError, and a reconnect
+// already installs a new transport -- by the time the stale read finally
+// errors and calls handleTransportError itself, it must be a no-op rather
+// than tearing down the perfectly good connection that replaced it.
+func TestHandleTransportErrorIgnoresStaleTransport(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	staleTransport := mock.NewMockTransport(ctrl)
+	currentTransport := mock.NewMockTransport(ctrl)
+
+	c := &client{
+		clientType: RegionClient,
+		transport:  currentTransport,
+		rpcs:       make(chan hrpc.Call, 1),
+		sent:       make(map[uint32]hrpc.Call),
+		done:       make(chan struct{}),
+		reconnect: &ReconnectPolicy{
+			MaxAttempts:    5,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     time.Millisecond,
+		},
+		dial: func() (net.Conn, error) { return fakeConn{}, nil },
+	}
+
+	// the in-flight RPC is on the good, current connection; a stale error
+	// must leave it alone.
+	result := make(chan hrpc.RPCResult, 1)
+	inFlight := mock.NewMockCall(ctrl)
+	c.sent[1] = inFlight
+
+	c.handleTransportError(staleTransport, errors.New("stale read failed"))
+
+	select {
+	case r := <-result:
+		t.Fatalf("stale transport error incorrectly drained an in-flight RPC: %#v", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if c.reconnecting {
+		t.Errorf("stale transport error incorrectly flipped the client into reconnecting")
+	}
+	if c.transport != currentTransport {
+		t.Errorf("stale transport error incorrectly replaced the current transport")
+	}
+}
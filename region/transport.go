@@ -0,0 +1,165 @@
+// Copyright (C) 2015  The GoHBase Authors.  All rights reserved.
+// This file is part of GoHBase.
+// Use of this source code is governed by the Apache License 2.0
+// that can be found in the COPYING file.
+
+package region
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/tsuna/gohbase/hrpc"
+	"github.com/tsuna/gohbase/pb"
+)
+
+// ErrShortWrite is used when the writer thread only succeeds in writing
+// part of its requested data, before encountering an error
+var ErrShortWrite = errors.New("short write occurred while sending RPC")
+
+// Transport owns the framing and handshake of the HBase RPC protocol: the
+// connection preamble, and the length-prefixed request/response envelopes
+// that every RPC is wrapped in. It exists so that callers can layer SASL/
+// GSSAPI auth, TLS, or a capture/replay decorator on top of a net.Conn
+// without having to patch package region itself; see WithTransport.
+type Transport interface {
+	// SendHello writes the HBase RPC connection preamble, identifying us
+	// as either a RegionClient or a MasterClient.
+	SendHello(ClientType) error
+
+	// WriteRPC frames and writes a single RPC's serialized payload.
+	WriteRPC(id uint32, name string, payload []byte) error
+
+	// ReadResponse blocks until a full response frame has arrived and
+	// returns the id of the RPC it answers along with its raw body.
+	ReadResponse() (id uint32, body []byte, err error)
+
+	// Close closes the underlying connection.
+	Close() error
+}
+
+// defaultTransport is the Transport used unless a caller supplies one via
+// WithTransport. It speaks the HBase RPC protocol directly over whatever
+// io.ReadWriteCloser it's given.
+type defaultTransport struct {
+	conn          io.ReadWriteCloser
+	effectiveUser string
+}
+
+// newDefaultTransport returns the factory NewClient uses by default: one
+// that frames RPCs directly on top of the net.Conn it's handed.
+func newDefaultTransport(effectiveUser string) func(net.Conn) Transport {
+	return func(conn net.Conn) Transport {
+		return &defaultTransport{conn: conn, effectiveUser: effectiveUser}
+	}
+}
+
+// write sends buf in full to the underlying connection, or returns
+// ErrShortWrite if the connection accepted fewer bytes than requested.
+func (t *defaultTransport) write(buf []byte) error {
+	n, err := t.conn.Write(buf)
+	if err != nil {
+		return err
+	}
+	if n != len(buf) {
+		return ErrShortWrite
+	}
+	return nil
+}
+
+func (t *defaultTransport) SendHello(clientType ClientType) error {
+	var serviceName string
+	switch clientType {
+	case RegionClient:
+		serviceName = "ClientService"
+	case MasterClient:
+		serviceName = "MasterService"
+	default:
+		return fmt.Errorf("unknown client type: %v", clientType)
+	}
+
+	connHeader := &pb.ConnectionHeader{
+		UserInfo: &pb.UserInformation{
+			EffectiveUser: proto.String(t.effectiveUser),
+		},
+		ServiceName: proto.String(serviceName),
+	}
+	data, err := proto.Marshal(connHeader)
+	if err != nil {
+		return fmt.Errorf("failed to marshal connection header: %s", err)
+	}
+
+	const magic = "HBas\x00P"
+	buf := make([]byte, 0, len(magic)+4+len(data))
+	buf = append(buf, magic...)
+	buf = append(buf, byte(len(data)>>24), byte(len(data)>>16), byte(len(data)>>8), byte(len(data)))
+	buf = append(buf, data...)
+
+	return t.write(buf)
+}
+
+func (t *defaultTransport) WriteRPC(id uint32, name string, payload []byte) error {
+	header := &pb.RequestHeader{
+		CallId:       proto.Uint32(id),
+		MethodName:   proto.String(name),
+		RequestParam: proto.Bool(true),
+	}
+	data, err := proto.Marshal(header)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request header: %s", err)
+	}
+
+	// The frame is a 4-byte total size, then the header and the payload,
+	// each prefixed with its varint-encoded length.
+	headerLen := proto.EncodeVarint(uint64(len(data)))
+	payloadLen := proto.EncodeVarint(uint64(len(payload)))
+	size := len(headerLen) + len(data) + len(payloadLen) + len(payload)
+	buf := make([]byte, 4, 4+size)
+	binary.BigEndian.PutUint32(buf, uint32(size))
+	buf = append(buf, headerLen...)
+	buf = append(buf, data...)
+	buf = append(buf, payloadLen...)
+	buf = append(buf, payload...)
+
+	return t.write(buf)
+}
+
+func (t *defaultTransport) ReadResponse() (uint32, []byte, error) {
+	sizeBuf := make([]byte, 4)
+	if _, err := io.ReadFull(t.conn, sizeBuf); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(sizeBuf)
+
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(t.conn, buf); err != nil {
+		return 0, nil, err
+	}
+
+	// Parsing of the pb.ResponseHeader that prefixes buf (to recover the
+	// call id) and of the RPC-specific pb.Message that follows it is
+	// elided here.
+	return parseResponseID(buf), buf, nil
+}
+
+// parseResponseID stands in for extracting the call id from a response
+// frame's leading pb.ResponseHeader. It does not decode the header: it
+// always returns 0.
+func parseResponseID(buf []byte) uint32 {
+	return 0
+}
+
+func (t *defaultTransport) Close() error {
+	return t.conn.Close()
+}
+
+// parseResponse stands in for decoding a response frame's body into the
+// hrpc.RPCResult to deliver to the caller waiting on it. It does not decode
+// body: it always returns an empty hrpc.RPCResult.
+func parseResponse(body []byte) hrpc.RPCResult {
+	return hrpc.RPCResult{}
+}
@@ -0,0 +1,110 @@
+// Copyright (C) 2015  The GoHBase Authors.  All rights reserved.
+// This file is part of GoHBase.
+// Use of this source code is governed by the Apache License 2.0
+// that can be found in the COPYING file.
+
+package region
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aristanetworks/goarista/test"
+	"github.com/golang/mock/gomock"
+	"github.com/tsuna/gohbase/test/mock"
+)
+
+func TestTransportWrite(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockConn := mock.NewMockReadWriteCloser(ctrl)
+	tr := &defaultTransport{conn: mockConn}
+
+	// check if write returns an error
+	expectErr := errors.New("nope")
+	mockConn.EXPECT().Write(gomock.Any()).Return(0, expectErr).Times(1)
+	err := tr.write([]byte("lol"))
+	if diff := test.Diff(expectErr, err); diff != "" {
+		t.Errorf("Expected: %#v\nReceived: %#v\nDiff:%s",
+			expectErr, err, diff)
+	}
+
+	// check if it returns ErrShortWrite
+	mockConn.EXPECT().Write(gomock.Any()).Return(1, nil).Times(1)
+	err = tr.write([]byte("lol"))
+	if diff := test.Diff(ErrShortWrite, err); diff != "" {
+		t.Errorf("Expected: %#v\nReceived: %#v\nDiff:%s",
+			ErrShortWrite, err, diff)
+	}
+
+	// check if it actually writes the right data
+	expected := []byte("lol")
+	mockConn.EXPECT().Write(gomock.Any()).Return(3, nil).Times(1).Do(func(buf []byte) {
+		if diff := test.Diff(expected, buf); diff != "" {
+			t.Errorf("Expected: %#v\nReceived: %#v\nDiff:%s",
+				expected, buf, diff)
+		}
+	})
+	err = tr.write(expected)
+	if err != nil {
+		t.Errorf("Was expecting no error, but got one: %#v", err)
+	}
+}
+
+func TestTransportSendHello(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockConn := mock.NewMockReadWriteCloser(ctrl)
+	tr := &defaultTransport{conn: mockConn, effectiveUser: "gopher"}
+
+	// check if it's sending the right "hello" for RegionClient
+	mockConn.EXPECT().Write(gomock.Any()).Return(35, nil).Times(1).Do(func(buf []byte) {
+		expected := []byte("HBas\x00P\x00\x00\x00\x19\n\b\n\x06gopher\x12\rClientService")
+		if diff := test.Diff(expected, buf); diff != "" {
+			t.Errorf("Type RegionClient:\n Expected: %#v\nReceived: %#v\nDiff:%s",
+				expected, buf, diff)
+		}
+	})
+	err := tr.SendHello(RegionClient)
+	if err != nil {
+		t.Errorf("Was expecting no error, but got one: %#v", err)
+	}
+
+	// check if it sends the right "hello" for MasterClient
+	mockConn.EXPECT().Write(gomock.Any()).Return(35, nil).Times(1).Do(func(buf []byte) {
+		expected := []byte("HBas\x00P\x00\x00\x00\x19\n\b\n\x06gopher\x12\rMasterService")
+		if diff := test.Diff(expected, buf); diff != "" {
+			t.Errorf("Type MasterClient:\n Expected: %#v\nReceived: %#v\nDiff:%s",
+				expected, buf, diff)
+		}
+	})
+	err = tr.SendHello(MasterClient)
+	if err != nil {
+		t.Errorf("Was expecting no error, but got one: %#v", err)
+	}
+}
+
+func TestTransportWriteRPC(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockConn := mock.NewMockReadWriteCloser(ctrl)
+	tr := &defaultTransport{conn: mockConn}
+
+	payload := []byte("rpc_0")
+	mockConn.EXPECT().Write(newRPCMatcher(string(payload))).Times(1).Return(
+		15+len(payload), nil)
+	if err := tr.WriteRPC(1, "lol", payload); err != nil {
+		t.Errorf("Was expecting no error, got: %#v", err)
+	}
+}
+
+func TestTransportClose(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockConn := mock.NewMockReadWriteCloser(ctrl)
+	mockConn.EXPECT().Close().Times(1)
+	tr := &defaultTransport{conn: mockConn}
+	if err := tr.Close(); err != nil {
+		t.Errorf("Was expecting no error, got: %#v", err)
+	}
+}